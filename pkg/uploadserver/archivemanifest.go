@@ -0,0 +1,195 @@
+/*
+ * This file is part of the CDI project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2024 Red Hat, Inc.
+ *
+ */
+
+package uploadserver
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/uploadserver/codec"
+)
+
+// archiveManifestHeader carries a JSON array of archiveManifestEntry,
+// mapping tar entries in the request body to on-disk destinations. This lets
+// a single PVC be populated from a firmware blob, a disk image, and a
+// cloud-init ISO (for example) in one request instead of one DataVolume per
+// file.
+const archiveManifestHeader = "X-CDI-Archive-Manifest"
+
+// archiveManifestUploadPath accepts a tar stream, optionally compressed per
+// the X-CDI-Upload-Encoding header, whose entries are routed to destinations
+// by archiveManifestHeader.
+const archiveManifestUploadPath = "/v1beta1/upload-archive-manifest"
+
+// archiveManifestEntry maps tar entries whose name matches Glob (as per
+// path.Match) to Destination, a filesystem path or block device.
+type archiveManifestEntry struct {
+	Glob        string `json:"glob"`
+	Destination string `json:"destination"`
+}
+
+func parseArchiveManifest(header string) ([]archiveManifestEntry, error) {
+	if header == "" {
+		return nil, errors.Errorf("missing %s header", archiveManifestHeader)
+	}
+
+	var manifest []archiveManifestEntry
+	if err := json.Unmarshal([]byte(header), &manifest); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s header", archiveManifestHeader)
+	}
+
+	return manifest, nil
+}
+
+func matchDestination(manifest []archiveManifestEntry, name string) (string, bool) {
+	for _, entry := range manifest {
+		if ok, err := path.Match(entry.Glob, name); err == nil && ok {
+			return entry.Destination, true
+		}
+	}
+	return "", false
+}
+
+func (app *uploadServerApp) archiveManifestHandler(irc imageReadCloser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.validateShouldHandleRequest(w, r, []string{http.MethodPost}, "") {
+			return
+		}
+
+		manifest, err := parseArchiveManifest(r.Header.Get(archiveManifestHeader))
+		if err != nil {
+			klog.Errorf("Invalid archive manifest: %v", err)
+			app.mutex.Lock()
+			app.uploading = false
+			app.mutex.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		readCloser, err := irc(r)
+		if err != nil {
+			app.mutex.Lock()
+			app.uploading = false
+			app.mutex.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		encoding := codec.Name(r.Header.Get(uploadEncodingHeader))
+		if encoding == "" {
+			encoding = codec.None
+		}
+
+		decoded, err := codec.NewReader(readCloser, encoding)
+		if err != nil {
+			klog.Errorf("Error negotiating upload encoding: %v", err)
+			app.mutex.Lock()
+			app.uploading = false
+			app.mutex.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		written, err := untarWithManifest(decoded, manifest)
+
+		app.mutex.Lock()
+		defer app.mutex.Unlock()
+
+		if err != nil {
+			klog.Errorf("Saving archive manifest upload failed: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			app.uploading = false
+			return
+		}
+
+		app.uploading = false
+		app.done = true
+		close(app.doneChan)
+
+		klog.Infof("Wrote %d archive manifest entries", written)
+	}
+}
+
+func untarWithManifest(stream io.Reader, manifest []archiveManifestEntry) (int, error) {
+	tr := tar.NewReader(stream)
+	written := 0
+
+	for {
+		header, err := tr.Next()
+		switch {
+		case err == io.EOF:
+			return written, nil
+		case err != nil:
+			return written, err
+		case header == nil:
+			continue
+		}
+
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeGNUSparse {
+			continue
+		}
+
+		dest, ok := matchDestination(manifest, header.Name)
+		if !ok {
+			klog.Warningf("No manifest destination for archive entry %s, skipping", header.Name)
+			continue
+		}
+
+		if err := writeManifestEntry(tr, dest); err != nil {
+			return written, errors.Wrapf(err, "error writing entry %s to %s", header.Name, dest)
+		}
+		written++
+	}
+}
+
+func writeManifestEntry(r io.Reader, dest string) error {
+	if info, statErr := os.Stat(dest); statErr == nil && info.Mode()&os.ModeDevice != 0 {
+		f, err := os.OpenFile(dest, os.O_WRONLY, os.ModeDevice|os.ModePerm)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(f, r)
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+		return err
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
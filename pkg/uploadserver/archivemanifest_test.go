@@ -0,0 +1,106 @@
+/*
+ * This file is part of the CDI project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2024 Red Hat, Inc.
+ *
+ */
+
+package uploadserver
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseArchiveManifest(t *testing.T) {
+	manifest, err := parseArchiveManifest(`[{"glob":"disk.img","destination":"/data/disk.img"},{"glob":"*.iso","destination":"/data/cloudinit.iso"}]`)
+	if err != nil {
+		t.Fatalf("parseArchiveManifest returned error: %v", err)
+	}
+	if len(manifest) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(manifest))
+	}
+}
+
+func TestParseArchiveManifestMissingHeader(t *testing.T) {
+	if _, err := parseArchiveManifest(""); err == nil {
+		t.Fatal("expected an error for a missing manifest header")
+	}
+}
+
+func TestMatchDestination(t *testing.T) {
+	manifest := []archiveManifestEntry{
+		{Glob: "disk.img", Destination: "/data/disk.img"},
+		{Glob: "*.iso", Destination: "/data/cloudinit.iso"},
+	}
+
+	if dest, ok := matchDestination(manifest, "disk.img"); !ok || dest != "/data/disk.img" {
+		t.Fatalf("expected disk.img to match /data/disk.img, got %q, %v", dest, ok)
+	}
+	if dest, ok := matchDestination(manifest, "seed.iso"); !ok || dest != "/data/cloudinit.iso" {
+		t.Fatalf("expected seed.iso to match /data/cloudinit.iso, got %q, %v", dest, ok)
+	}
+	if _, ok := matchDestination(manifest, "unmapped.bin"); ok {
+		t.Fatal("expected no match for an entry with no corresponding glob")
+	}
+}
+
+func TestUntarWithManifest(t *testing.T) {
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	contents := map[string]string{
+		"firmware.fd": "firmware-bytes",
+		"disk.img":    "disk-bytes",
+	}
+	for name, content := range contents {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(content)), Mode: 0600}); err != nil {
+			t.Fatalf("writing tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("writing tar content: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("closing tar writer: %v", err)
+	}
+
+	manifest := []archiveManifestEntry{
+		{Glob: "firmware.fd", Destination: filepath.Join(dir, "firmware.fd")},
+		{Glob: "disk.img", Destination: filepath.Join(dir, "disk.img")},
+	}
+
+	written, err := untarWithManifest(&buf, manifest)
+	if err != nil {
+		t.Fatalf("untarWithManifest returned error: %v", err)
+	}
+	if written != 2 {
+		t.Fatalf("expected 2 entries written, got %d", written)
+	}
+
+	for name, content := range contents {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("reading %s: %v", name, err)
+		}
+		if string(got) != content {
+			t.Fatalf("expected %s to contain %q, got %q", name, content, got)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/*
+ * This file is part of the CDI project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2024 Red Hat, Inc.
+ *
+ */
+
+package uploadserver
+
+import (
+	"crypto/hmac"
+	"crypto/md5"  //nolint:gosec // checksum extension allows weaker algorithms for client compatibility
+	"crypto/sha1" //nolint:gosec // checksum extension allows weaker algorithms for client compatibility
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+)
+
+// uploadChecksumHeader carries the tus checksum extension header: an
+// algorithm name and a base64-encoded digest of the raw uploaded bytes, e.g.
+// "sha256 <b64>". See https://tus.io/protocols/resumable-upload#checksum
+const uploadChecksumHeader = "Upload-Checksum"
+
+// statusChecksumMismatch mirrors the status code suggested by the tus
+// checksum extension for a failed verification.
+const statusChecksumMismatch = 460
+
+func newChecksumHash(algo string) (hash.Hash, error) {
+	switch strings.ToLower(algo) {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "md5":
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algo)
+	}
+}
+
+func parseChecksumHeader(header string) (algo string, digest []byte, err error) {
+	if header == "" {
+		return "", nil, nil
+	}
+
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("malformed %s header %q", uploadChecksumHeader, header)
+	}
+
+	digest, err = base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "invalid %s digest", uploadChecksumHeader)
+	}
+
+	return strings.ToLower(parts[0]), digest, nil
+}
+
+func verifyChecksum(h hash.Hash, want []byte) error {
+	if got := h.Sum(nil); !hmac.Equal(got, want) {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", base64.StdEncoding.EncodeToString(want), base64.StdEncoding.EncodeToString(got))
+	}
+	return nil
+}
+
+// checksumVerifier tees a full upload body through a digest as it is
+// consumed by the processing pipeline, so the raw bytes can be verified
+// end-to-end once processing has finished reading them.
+type checksumVerifier struct {
+	algo string
+	want []byte
+	hash hash.Hash
+}
+
+// newChecksumVerifier returns nil, nil if header is empty, since checksum
+// verification is an optional, opt-in part of the upload request.
+func newChecksumVerifier(header string) (*checksumVerifier, error) {
+	algo, want, err := parseChecksumHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	if algo == "" {
+		return nil, nil
+	}
+
+	h, err := newChecksumHash(algo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &checksumVerifier{algo: algo, want: want, hash: h}, nil
+}
+
+func (c *checksumVerifier) wrap(rc io.ReadCloser) io.ReadCloser {
+	return &teeReadCloser{Reader: io.TeeReader(rc, c.hash), closer: rc}
+}
+
+func (c *checksumVerifier) verify() error {
+	return verifyChecksum(c.hash, c.want)
+}
+
+type teeReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (t *teeReadCloser) Close() error {
+	return t.closer.Close()
+}
+
+// cleanupFailedDestination removes a partially written destination after a
+// checksum mismatch so the PVC isn't left holding corrupt data. CDI doesn't
+// own a block device node's lifecycle, so rather than unlinking it, the
+// device's contents are zeroed out; the caller is expected to surface an
+// error so the DataVolume is marked failed rather than silently reused.
+func (app *uploadServerApp) cleanupFailedDestination(dest string) {
+	info, err := os.Stat(dest)
+	if err != nil {
+		return
+	}
+
+	if info.Mode()&os.ModeDevice != 0 {
+		if err := zeroBlockDevice(dest); err != nil {
+			klog.Errorf("Failed to zero block device %s after checksum failure: %v", dest, err)
+		} else {
+			klog.Warningf("Checksum verification failed; zeroed block device %s", dest)
+		}
+		return
+	}
+
+	if err := os.Remove(dest); err != nil {
+		klog.Errorf("Failed to remove partial destination %s after checksum failure: %v", dest, err)
+	}
+}
+
+// zeroBlockDevice overwrites dest, a block device node, with zeroes from
+// start to its full size so a checksum failure doesn't leave corrupt data
+// behind on a block-mode PVC.
+func zeroBlockDevice(dest string) error {
+	f, err := os.OpenFile(dest, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	zero := make([]byte, 1024*1024)
+	for remaining := size; remaining > 0; {
+		n := int64(len(zero))
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := f.Write(zero[:n]); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+
+	return nil
+}
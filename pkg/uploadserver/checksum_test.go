@@ -0,0 +1,92 @@
+/*
+ * This file is part of the CDI project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2024 Red Hat, Inc.
+ *
+ */
+
+package uploadserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNewChecksumVerifier(t *testing.T) {
+	payload := "raw uploaded bytes"
+	sum := sha256.Sum256([]byte(payload))
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+
+	verifier, err := newChecksumVerifier("sha256 " + digest)
+	if err != nil {
+		t.Fatalf("newChecksumVerifier returned error: %v", err)
+	}
+	if verifier == nil {
+		t.Fatal("expected a non-nil verifier")
+	}
+
+	rc := verifier.wrap(io.NopCloser(strings.NewReader(payload)))
+	if _, err := io.ReadAll(rc); err != nil {
+		t.Fatalf("reading wrapped stream: %v", err)
+	}
+
+	if err := verifier.verify(); err != nil {
+		t.Fatalf("expected checksum to match, got error: %v", err)
+	}
+}
+
+func TestNewChecksumVerifierMismatch(t *testing.T) {
+	sum := sha256.Sum256([]byte("expected bytes"))
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+
+	verifier, err := newChecksumVerifier("sha256 " + digest)
+	if err != nil {
+		t.Fatalf("newChecksumVerifier returned error: %v", err)
+	}
+
+	rc := verifier.wrap(io.NopCloser(strings.NewReader("corrupted bytes")))
+	if _, err := io.ReadAll(rc); err != nil {
+		t.Fatalf("reading wrapped stream: %v", err)
+	}
+
+	if err := verifier.verify(); err == nil {
+		t.Fatal("expected a checksum mismatch error")
+	}
+}
+
+func TestNewChecksumVerifierNoHeader(t *testing.T) {
+	verifier, err := newChecksumVerifier("")
+	if err != nil {
+		t.Fatalf("newChecksumVerifier returned error: %v", err)
+	}
+	if verifier != nil {
+		t.Fatal("expected a nil verifier when no checksum header is present")
+	}
+}
+
+func TestParseChecksumHeaderMalformed(t *testing.T) {
+	if _, _, err := parseChecksumHeader("sha256"); err == nil {
+		t.Fatal("expected an error for a header missing the digest")
+	}
+}
+
+func TestNewChecksumVerifierUnsupportedAlgorithm(t *testing.T) {
+	if _, err := newChecksumVerifier("crc32 AAAA"); err == nil {
+		t.Fatal("expected an error for an unsupported algorithm")
+	}
+}
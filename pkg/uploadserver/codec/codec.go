@@ -0,0 +1,106 @@
+/*
+ * This file is part of the CDI project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2024 Red Hat, Inc.
+ *
+ */
+
+// Package codec provides pluggable decompression for upload/clone streams.
+// The uploadserver selects an implementation from the X-CDI-Upload-Encoding
+// header a request carries; Snappy remains the default so older clients that
+// never send the header keep working unchanged.
+//
+// This package only implements the server (decode) half of that negotiation.
+// Nothing in this tree emits X-CDI-Upload-Encoding: the clone-source/
+// upload-proxy client that would choose Zstd or Gzip for a given transfer
+// lives outside this repo snapshot, so in practice every request still
+// arrives as Snappy today. Zstd/Gzip are registered and exercised by
+// benchmarks so the decode path is ready the day a client opts in, but until
+// a client sends the header, switching codecs requires a manual
+// X-CDI-Upload-Encoding header on the request.
+package codec
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Name identifies a registered codec.
+type Name string
+
+const (
+	// Snappy is the historical default codec used by smart-clone/upload-proxy.
+	Snappy Name = "snappy"
+	// Zstd trades a bit of CPU for materially better ratios on sparse qcow2 streams.
+	Zstd Name = "zstd"
+	// Gzip is provided for interoperability with generic HTTP clients.
+	Gzip Name = "gzip"
+	// None bypasses decompression entirely.
+	None Name = "none"
+)
+
+// Decoder wraps a compressed stream in a decompressing io.ReadCloser.
+type Decoder interface {
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type decoderFunc func(r io.Reader) (io.ReadCloser, error)
+
+func (f decoderFunc) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return f(r)
+}
+
+var registry = map[Name]Decoder{
+	Snappy: decoderFunc(func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(snappy.NewReader(r)), nil
+	}),
+	Gzip: decoderFunc(func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	}),
+	None: decoderFunc(func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(r), nil
+	}),
+	Zstd: decoderFunc(func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}),
+}
+
+// DefaultName is used when a stream carries no explicit encoding, preserving
+// the historical Snappy-only behavior.
+const DefaultName = Snappy
+
+// NewReader returns a decompressing reader for the named codec. An empty name
+// resolves to DefaultName for backward compatibility with clients that
+// predate the X-CDI-Upload-Encoding header.
+func NewReader(r io.Reader, name Name) (io.ReadCloser, error) {
+	if name == "" {
+		name = DefaultName
+	}
+
+	decoder, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown upload encoding %q", name)
+	}
+
+	return decoder.NewReader(r)
+}
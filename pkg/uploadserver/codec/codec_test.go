@@ -0,0 +1,181 @@
+/*
+ * This file is part of the CDI project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2024 Red Hat, Inc.
+ *
+ */
+
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// diskImagePayload builds a payload shaped like a real disk image for
+// benchmarking purposes: alternating runs of zeroed (unallocated) clusters
+// and pseudo-random (allocated) cluster data, rather than payloads that are
+// either all zero or all random and so compress unrealistically well or
+// poorly compared to actual qcow2/raw clone streams.
+func diskImagePayload(size int) []byte {
+	const clusterSize = 64 << 10
+
+	payload := make([]byte, size)
+	rnd := rand.New(rand.NewSource(42))
+
+	for off := 0; off < size; off += clusterSize {
+		end := off + clusterSize
+		if end > size {
+			end = size
+		}
+		// Roughly a third of clusters are "allocated" and filled with
+		// random data; the rest stay zeroed, similar to a sparse disk.
+		if off/clusterSize%3 == 0 {
+			rnd.Read(payload[off:end])
+		}
+	}
+
+	return payload
+}
+
+func compress(t testing.TB, name Name, payload []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	switch name {
+	case Snappy:
+		w := snappy.NewBufferedWriter(&buf)
+		if _, err := w.Write(payload); err != nil {
+			t.Fatalf("writing snappy payload: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("closing snappy writer: %v", err)
+		}
+	case Gzip:
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(payload); err != nil {
+			t.Fatalf("writing gzip payload: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("closing gzip writer: %v", err)
+		}
+	case Zstd:
+		w, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("creating zstd writer: %v", err)
+		}
+		if _, err := w.Write(payload); err != nil {
+			t.Fatalf("writing zstd payload: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("closing zstd writer: %v", err)
+		}
+	case None:
+		buf.Write(payload)
+	}
+
+	return buf.Bytes()
+}
+
+func TestNewReaderRoundTrip(t *testing.T) {
+	payload := []byte("qcow2 cluster payload used for codec round-trip testing")
+
+	for _, name := range []Name{Snappy, Gzip, Zstd, None} {
+		name := name
+		t.Run(string(name), func(t *testing.T) {
+			compressed := compress(t, name, payload)
+
+			reader, err := NewReader(bytes.NewReader(compressed), name)
+			if err != nil {
+				t.Fatalf("NewReader(%s) returned error: %v", name, err)
+			}
+			defer reader.Close()
+
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("reading decoded stream: %v", err)
+			}
+
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("decoded payload mismatch: got %q, want %q", got, payload)
+			}
+		})
+	}
+}
+
+func TestNewReaderDefaultsToSnappy(t *testing.T) {
+	payload := []byte("backward compatible clients never send X-CDI-Upload-Encoding")
+	compressed := compress(t, Snappy, payload)
+
+	reader, err := NewReader(bytes.NewReader(compressed), "")
+	if err != nil {
+		t.Fatalf("NewReader(\"\") returned error: %v", err)
+	}
+	defer reader.Close()
+
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading decoded stream: %v", err)
+	}
+
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("decoded payload mismatch: got %q, want %q", got, payload)
+	}
+}
+
+func TestNewReaderUnknownEncoding(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader(nil), Name("lz4")); err == nil {
+		t.Fatal("expected an error for an unregistered codec")
+	}
+}
+
+func benchmarkDecode(b *testing.B, name Name, size int) {
+	payload := diskImagePayload(size)
+	compressed := compress(b, name, payload)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+
+	for i := 0; i < b.N; i++ {
+		reader, err := NewReader(bytes.NewReader(compressed), name)
+		if err != nil {
+			b.Fatalf("NewReader(%s) returned error: %v", name, err)
+		}
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			b.Fatalf("decoding stream: %v", err)
+		}
+		reader.Close()
+	}
+}
+
+func BenchmarkDecodeSnappy(b *testing.B) {
+	benchmarkDecode(b, Snappy, 64<<20)
+}
+
+func BenchmarkDecodeZstd(b *testing.B) {
+	benchmarkDecode(b, Zstd, 64<<20)
+}
+
+func BenchmarkDecodeGzip(b *testing.B) {
+	benchmarkDecode(b, Gzip, 64<<20)
+}
@@ -0,0 +1,158 @@
+/*
+ * This file is part of the CDI project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2024 Red Hat, Inc.
+ *
+ */
+
+package uploadserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	metricsPath  = "/metrics"
+	progressPath = "/v1beta1/upload/progress"
+)
+
+var (
+	uploadBytesReceivedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cdi_uploadserver_upload_bytes_received_total",
+		Help: "Total bytes read from upload request bodies by this uploadserver pod.",
+	})
+	uploadDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cdi_uploadserver_upload_duration_seconds",
+		Help:    "Time to receive and hand off an upload request, in seconds.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	processingDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cdi_uploadserver_processing_duration_seconds",
+		Help:    "Time spent converting/writing an uploaded image to its destination, in seconds.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	preallocationAppliedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cdi_uploadserver_preallocation_applied_total",
+		Help: "Number of uploads for which preallocation was applied.",
+	})
+	validationFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cdi_uploadserver_validation_failures_total",
+		Help: "Number of upload requests rejected by validateShouldHandleRequest.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		uploadBytesReceivedTotal,
+		uploadDurationSeconds,
+		processingDurationSeconds,
+		preallocationAppliedTotal,
+		validationFailuresTotal,
+	)
+}
+
+// progress is the JSON body served at progressPath.
+type progress struct {
+	BytesReceived int64     `json:"bytesReceived"`
+	TotalBytes    int64     `json:"totalBytes"`
+	Phase         string    `json:"phase"`
+	StartedAt     time.Time `json:"startedAt"`
+}
+
+// countingReadCloser counts bytes as they're read off an upload body, both
+// into the shared Prometheus counter and into a per-upload counter the
+// progress endpoint reads from.
+type countingReadCloser struct {
+	io.ReadCloser
+	bytesRead *int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		atomic.AddInt64(c.bytesRead, int64(n))
+		uploadBytesReceivedTotal.Add(float64(n))
+	}
+	return n, err
+}
+
+// startProgress resets the per-upload progress counters at the start of a
+// new upload request. totalBytes is best-effort: it's whatever the client
+// reported via Content-Length, or 0 if it streamed the body without one.
+func (app *uploadServerApp) startProgress(totalBytes int64) {
+	if totalBytes < 0 {
+		totalBytes = 0
+	}
+	atomic.StoreInt64(&app.progressBytesReceived, 0)
+
+	app.mutex.Lock()
+	app.progressTotalBytes = totalBytes
+	app.progressStartedAt = time.Now()
+	app.mutex.Unlock()
+}
+
+// countingUploadReader wraps rc so bytesReceived/metrics stay accurate
+// whether the body came from bodyReadCloser or formReadCloser.
+func (app *uploadServerApp) countingUploadReader(rc io.ReadCloser) io.ReadCloser {
+	return &countingReadCloser{ReadCloser: rc, bytesRead: &app.progressBytesReceived}
+}
+
+func (app *uploadServerApp) recordPreallocationApplied(applied bool) {
+	if applied {
+		preallocationAppliedTotal.Inc()
+	}
+}
+
+func (app *uploadServerApp) progressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	app.mutex.Lock()
+	phase := "uploading"
+	switch {
+	case app.done:
+		phase = "done"
+	case app.processing:
+		phase = "processing"
+	}
+	p := progress{
+		TotalBytes: app.progressTotalBytes,
+		Phase:      phase,
+		StartedAt:  app.progressStartedAt,
+	}
+	app.mutex.Unlock()
+
+	p.BytesReceived = atomic.LoadInt64(&app.progressBytesReceived)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		klog.Errorf("progressHandler: failed to send response; %v", err)
+	}
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
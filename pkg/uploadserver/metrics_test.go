@@ -0,0 +1,80 @@
+/*
+ * This file is part of the CDI project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2024 Red Hat, Inc.
+ *
+ */
+
+package uploadserver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCountingReadCloserCountsBytes(t *testing.T) {
+	app := &uploadServerApp{}
+	payload := "hello world"
+
+	rc := app.countingUploadReader(io.NopCloser(strings.NewReader(payload)))
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if string(got) != payload {
+		t.Fatalf("got %q, want %q", got, payload)
+	}
+
+	if n := atomic.LoadInt64(&app.progressBytesReceived); n != int64(len(payload)) {
+		t.Fatalf("progressBytesReceived = %d, want %d", n, len(payload))
+	}
+}
+
+func TestProgressHandlerReportsPhase(t *testing.T) {
+	app := &uploadServerApp{}
+	app.startProgress(100)
+	atomic.StoreInt64(&app.progressBytesReceived, 42)
+
+	req := httptest.NewRequest(http.MethodGet, progressPath, nil)
+	rr := httptest.NewRecorder()
+	app.progressHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+
+	body := rr.Body.String()
+	for _, want := range []string{`"bytesReceived":42`, `"totalBytes":100`, `"phase":"uploading"`} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("response %q does not contain %q", body, want)
+		}
+	}
+}
+
+func TestProgressHandlerRejectsNonGet(t *testing.T) {
+	app := &uploadServerApp{}
+
+	req := httptest.NewRequest(http.MethodPost, progressPath, nil)
+	rr := httptest.NewRecorder()
+	app.progressHandler(rr, req)
+
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status 405, got %d", rr.Code)
+	}
+}
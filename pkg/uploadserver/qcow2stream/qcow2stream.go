@@ -0,0 +1,309 @@
+/*
+ * This file is part of the CDI project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2024 Red Hat, Inc.
+ *
+ */
+
+// Package qcow2stream converts a qcow2 stream straight onto its destination
+// offsets as it arrives over HTTP, instead of staging the whole image on the
+// scratch volume first and running qemu-img convert afterwards. It only
+// understands the common case produced by qemu-img convert -O qcow2 (an
+// uncompressed, unencrypted image with no backing file, whose L1/L2 metadata
+// is laid out before the data clusters it describes). Anything else bails
+// out with ErrNotStreamable so the caller can fall back to the existing
+// scratch-based path.
+package qcow2stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	qcow2Magic           = 0x514649fb // "QFI\xfb"
+	maxSupportedVersion  = 3
+	l1EntryOffsetMask    = 0x00fffffffffffe00
+	l2EntryOffsetMask    = 0x00fffffffffffe00
+	l2EntryCompressedBit = 1 << 62
+
+	// l2EntryZeroFlag is QCOW_OFLAG_ZERO (bit 0 of a standard, v3 L2 entry):
+	// the cluster reads as all zeros regardless of whatever host offset the
+	// rest of the entry carries, e.g. after a discard that didn't bother
+	// clearing the offset.
+	l2EntryZeroFlag = 1
+
+	// minClusterBits/maxClusterBits are the legal range for qcow2's
+	// cluster_bits header field (512B..2MiB clusters); anything outside it
+	// is a malformed header, not a real qcow2 image.
+	minClusterBits = 9
+	maxClusterBits = 21
+
+	// maxL1Entries bounds how large an L1 table we're willing to allocate
+	// for; at maxClusterBits this already covers a 2^59-byte (half an EiB)
+	// virtual disk, so a larger l1_size is a malformed/hostile header rather than a
+	// real image.
+	maxL1Entries = 1 << 20
+)
+
+// ErrNotStreamable means the qcow2 image can't be converted cluster-by-
+// cluster without scratch staging: an unsupported version, a backing file,
+// encryption, compressed clusters, or metadata that isn't laid out before
+// the data it describes.
+var ErrNotStreamable = errors.New("qcow2 image is not eligible for streaming conversion")
+
+type header struct {
+	version       uint32
+	backingOffset uint64
+	size          uint64
+	clusterBits   uint32
+	cryptMethod   uint32
+	l1Size        uint32
+	l1TableOffset uint64
+}
+
+func readHeader(r io.Reader) (*header, error) {
+	buf := make([]byte, 72)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(buf[0:4]) != qcow2Magic {
+		return nil, errors.Wrap(ErrNotStreamable, "not a qcow2 stream")
+	}
+
+	h := &header{
+		version:       binary.BigEndian.Uint32(buf[4:8]),
+		backingOffset: binary.BigEndian.Uint64(buf[8:16]),
+		clusterBits:   binary.BigEndian.Uint32(buf[20:24]),
+		size:          binary.BigEndian.Uint64(buf[24:32]),
+		cryptMethod:   binary.BigEndian.Uint32(buf[32:36]),
+		l1Size:        binary.BigEndian.Uint32(buf[36:40]),
+		l1TableOffset: binary.BigEndian.Uint64(buf[40:48]),
+	}
+
+	if h.clusterBits < minClusterBits || h.clusterBits > maxClusterBits {
+		return nil, errors.Wrapf(ErrNotStreamable, "cluster_bits %d out of range", h.clusterBits)
+	}
+	if h.l1Size > maxL1Entries {
+		return nil, errors.Wrapf(ErrNotStreamable, "l1_size %d exceeds maximum of %d entries", h.l1Size, maxL1Entries)
+	}
+
+	if h.version >= 3 {
+		// v3 adds a fixed 32-byte extension plus a variable-length header;
+		// header_length (at absolute header offset 100, i.e. extra[28:32])
+		// tells us how much more to skip before the first extension header /
+		// L1 table.
+		extra := make([]byte, 32)
+		if _, err := io.ReadFull(r, extra); err != nil {
+			return nil, err
+		}
+		headerLength := int64(binary.BigEndian.Uint32(extra[28:32]))
+		if remaining := headerLength - 104; remaining > 0 {
+			if _, err := io.CopyN(io.Discard, r, remaining); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return h, nil
+}
+
+// TryConvert attempts to stream a qcow2 image directly onto destPath's
+// offsets as it reads r. preallocation mirrors the preallocation option on
+// the rest of the upload path: when true, every cluster of the virtual disk
+// is materialized on destPath rather than left as a sparse hole.
+//
+// On success it returns (nil, preallocationApplied, nil): destPath now holds
+// the fully converted raw image, sized to the qcow2 image's virtual size.
+//
+// If the image turns out not to be eligible, it returns a non-nil replay
+// reader that reproduces r exactly — the bytes already consumed while
+// inspecting the header/L1/L2 tables, followed by whatever remains of r —
+// along with an error wrapping ErrNotStreamable, so the caller can fall back
+// to the scratch-based path using replay in place of r.
+//
+// Once TryConvert starts writing cluster data to destPath it has committed:
+// a failure past that point returns a nil replay reader, since destPath may
+// already be partially written and a scratch-based retry could not safely
+// resume.
+func TryConvert(r io.Reader, destPath string, preallocation bool) (replay io.Reader, preallocationApplied bool, err error) {
+	var consumed bytes.Buffer
+	tee := io.TeeReader(r, &consumed)
+
+	notStreamable := func(err error) (io.Reader, bool, error) {
+		return io.MultiReader(bytes.NewReader(consumed.Bytes()), r), false, err
+	}
+
+	h, err := readHeader(tee)
+	if err != nil {
+		return notStreamable(errors.Wrap(err, "error reading qcow2 header"))
+	}
+	if h.version > maxSupportedVersion {
+		return notStreamable(errors.Wrapf(ErrNotStreamable, "unsupported qcow2 version %d", h.version))
+	}
+	if h.backingOffset != 0 {
+		return notStreamable(errors.Wrap(ErrNotStreamable, "image has a backing file"))
+	}
+	if h.cryptMethod != 0 {
+		return notStreamable(errors.Wrap(ErrNotStreamable, "image is encrypted"))
+	}
+
+	clusterSize := int64(1) << h.clusterBits
+	l2EntriesPerTable := clusterSize / 8
+	physOffset := int64(consumed.Len())
+
+	if int64(h.l1TableOffset) < physOffset {
+		return notStreamable(errors.Wrap(ErrNotStreamable, "L1 table precedes the current stream position"))
+	}
+	if _, err := io.CopyN(io.Discard, tee, int64(h.l1TableOffset)-physOffset); err != nil {
+		return notStreamable(err)
+	}
+	physOffset = int64(h.l1TableOffset)
+
+	l1 := make([]byte, int64(h.l1Size)*8)
+	if _, err := io.ReadFull(tee, l1); err != nil {
+		return notStreamable(err)
+	}
+	physOffset += int64(len(l1))
+
+	// hostToVirtual maps the physical offset a data cluster arrives at (its
+	// host offset, per the L2 table) to the offset it belongs at in the raw
+	// image (its virtual/guest offset).
+	hostToVirtual := map[int64]int64{}
+	minHostOffset := int64(-1)
+
+	for l1Index := 0; l1Index < int(h.l1Size); l1Index++ {
+		entry := binary.BigEndian.Uint64(l1[l1Index*8 : l1Index*8+8])
+		l2Offset := int64(entry & l1EntryOffsetMask)
+		if l2Offset == 0 {
+			continue // unallocated L2 table: every cluster it would cover reads as zero
+		}
+
+		if l2Offset < physOffset {
+			return notStreamable(errors.Wrap(ErrNotStreamable, "L2 table precedes the current stream position"))
+		}
+		if _, err := io.CopyN(io.Discard, tee, l2Offset-physOffset); err != nil {
+			return notStreamable(err)
+		}
+		physOffset = l2Offset
+
+		l2 := make([]byte, l2EntriesPerTable*8)
+		if _, err := io.ReadFull(tee, l2); err != nil {
+			return notStreamable(err)
+		}
+		physOffset += int64(len(l2))
+
+		for l2Index := int64(0); l2Index < l2EntriesPerTable; l2Index++ {
+			l2Entry := binary.BigEndian.Uint64(l2[l2Index*8 : l2Index*8+8])
+			if l2Entry&l2EntryCompressedBit != 0 {
+				return notStreamable(errors.Wrap(ErrNotStreamable, "image contains compressed clusters"))
+			}
+			if l2Entry&l2EntryZeroFlag != 0 {
+				continue // QCOW_OFLAG_ZERO: reads as zero regardless of host offset
+			}
+
+			hostOffset := int64(l2Entry & l2EntryOffsetMask)
+			if hostOffset == 0 {
+				continue // unallocated cluster: reads as zero
+			}
+
+			virtualOffset := (int64(l1Index)*l2EntriesPerTable + l2Index) * clusterSize
+			hostToVirtual[hostOffset] = virtualOffset
+			if minHostOffset == -1 || hostOffset < minHostOffset {
+				minHostOffset = hostOffset
+			}
+		}
+	}
+
+	if minHostOffset != -1 && minHostOffset < physOffset {
+		return notStreamable(errors.Wrap(ErrNotStreamable, "a data cluster precedes the end of the image's metadata"))
+	}
+
+	// Every cluster offset we need is now known: commit to writing directly.
+	out, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, false, err
+	}
+	defer out.Close()
+
+	virtualSize := int64(h.size)
+	allocated := make(map[int64]bool, len(hostToVirtual))
+
+	// From here on we've committed to writing dest directly (see the doc
+	// comment above): read the remaining cluster data straight from r
+	// instead of tee, so it streams onto disk instead of also buffering in
+	// consumed, which would otherwise hold the entire image in memory.
+	buf := make([]byte, clusterSize)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			if virtualOffset, ok := hostToVirtual[physOffset]; ok {
+				if _, err := out.WriteAt(buf[:n], virtualOffset); err != nil {
+					return nil, false, err
+				}
+				allocated[virtualOffset] = true
+			}
+			physOffset += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return nil, false, readErr
+		}
+	}
+
+	// Size the raw file to the qcow2 image's virtual size: clusters past the
+	// last allocated one in the source image would otherwise leave the raw
+	// output short. A block device keeps its own fixed size and can't be
+	// truncated, so only a regular file is resized.
+	info, err := out.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Mode().IsRegular() {
+		if err := out.Truncate(virtualSize); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if !preallocation {
+		return nil, false, nil
+	}
+
+	// Materialize every unallocated cluster so the destination holds no
+	// sparse holes, matching what preallocation means for the rest of the
+	// upload path.
+	zero := make([]byte, clusterSize)
+	for offset := int64(0); offset < virtualSize; offset += clusterSize {
+		if allocated[offset] {
+			continue
+		}
+		n := clusterSize
+		if remaining := virtualSize - offset; remaining < n {
+			n = remaining
+		}
+		if _, err := out.WriteAt(zero[:n], offset); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return nil, true, nil
+}
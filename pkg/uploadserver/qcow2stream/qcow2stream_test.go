@@ -0,0 +1,336 @@
+/*
+ * This file is part of the CDI project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2024 Red Hat, Inc.
+ *
+ */
+
+package qcow2stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// alignUp rounds off up to the next multiple of clusterSize, as real qcow2
+// images do for every L1/L2/data cluster offset (TryConvert keys data
+// clusters by the exact host offset in their L2 entry, so they must land on
+// cluster boundaries in the stream).
+func alignUp(off, clusterSize int64) int64 {
+	if rem := off % clusterSize; rem != 0 {
+		off += clusterSize - rem
+	}
+	return off
+}
+
+// buildQcow2V2 lays out a minimal, uncompressed v2 qcow2 image with a single
+// data cluster, matching the layout qemu-img convert produces: header, then
+// L1 table, then L2 table, then the data cluster itself, each on its own
+// cluster-aligned boundary.
+func buildQcow2V2(t *testing.T, clusterBits uint32, cluster []byte) []byte {
+	t.Helper()
+
+	clusterSize := int64(1) << clusterBits
+	l1Offset := alignUp(72, clusterSize)
+	l2Offset := alignUp(l1Offset+8, clusterSize) // a single L1 entry
+	dataOffset := alignUp(l2Offset+clusterSize/8*8, clusterSize)
+
+	buf := make([]byte, dataOffset)
+
+	binary.BigEndian.PutUint32(buf[0:4], qcow2Magic)
+	binary.BigEndian.PutUint32(buf[4:8], 2) // version
+	binary.BigEndian.PutUint32(buf[20:24], clusterBits)
+	binary.BigEndian.PutUint64(buf[24:32], uint64(clusterSize)) // size: one cluster's worth
+	binary.BigEndian.PutUint32(buf[36:40], 1)                   // l1_size
+	binary.BigEndian.PutUint64(buf[40:48], uint64(l1Offset))
+
+	binary.BigEndian.PutUint64(buf[l1Offset:l1Offset+8], uint64(l2Offset))
+	binary.BigEndian.PutUint64(buf[l2Offset:l2Offset+8], uint64(dataOffset))
+
+	return append(buf, cluster...)
+}
+
+// buildQcow2SparseTail lays out a v2 qcow2 image with l1Size L1 entries, a
+// single allocated cluster at L2 index 0 of allocatedL1Index, and every
+// other cluster left unallocated — exercising a sparse tail past the last
+// written data, the way a real disk image with free space would. The
+// returned virtualSize covers the full address range spanned by l1Size L2
+// tables.
+func buildQcow2SparseTail(t *testing.T, clusterBits uint32, l1Size, allocatedL1Index int, cluster []byte) (image []byte, virtualSize int64) {
+	t.Helper()
+
+	clusterSize := int64(1) << clusterBits
+	l2EntriesPerTable := clusterSize / 8
+	virtualSize = int64(l1Size) * l2EntriesPerTable * clusterSize
+
+	l1Offset := alignUp(72, clusterSize)
+	l2Offset := alignUp(l1Offset+int64(l1Size)*8, clusterSize)
+	dataOffset := alignUp(l2Offset+l2EntriesPerTable*8, clusterSize)
+
+	buf := make([]byte, dataOffset)
+
+	binary.BigEndian.PutUint32(buf[0:4], qcow2Magic)
+	binary.BigEndian.PutUint32(buf[4:8], 2) // version
+	binary.BigEndian.PutUint32(buf[20:24], clusterBits)
+	binary.BigEndian.PutUint64(buf[24:32], uint64(virtualSize))
+	binary.BigEndian.PutUint32(buf[36:40], uint32(l1Size))
+	binary.BigEndian.PutUint64(buf[40:48], uint64(l1Offset))
+
+	// Only allocatedL1Index points at an L2 table; every other L1 entry
+	// stays zero (unallocated L2 table: reads as zero).
+	l1EntryOff := l1Offset + int64(allocatedL1Index)*8
+	binary.BigEndian.PutUint64(buf[l1EntryOff:l1EntryOff+8], uint64(l2Offset))
+
+	// Only L2 index 0 of the allocated table points at the data cluster.
+	binary.BigEndian.PutUint64(buf[l2Offset:l2Offset+8], uint64(dataOffset))
+
+	return append(buf, cluster...), virtualSize
+}
+
+func TestTryConvertStreamsSimpleImage(t *testing.T) {
+	clusterBits := uint32(16) // 64KiB clusters
+	clusterSize := int64(1) << clusterBits
+	cluster := bytes.Repeat([]byte{0xAB}, int(clusterSize))
+
+	image := buildQcow2V2(t, clusterBits, cluster)
+
+	destPath := filepath.Join(t.TempDir(), "disk.raw")
+
+	replay, preallocationApplied, err := TryConvert(bytes.NewReader(image), destPath, false)
+	if err != nil {
+		t.Fatalf("TryConvert returned error: %v", err)
+	}
+	if replay != nil {
+		t.Fatal("expected a nil replay reader on success")
+	}
+	if preallocationApplied {
+		t.Fatal("expected preallocationApplied to be false when not requested")
+	}
+
+	got, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("reading converted image: %v", err)
+	}
+	if !bytes.Equal(got, cluster) {
+		t.Fatalf("converted image mismatch: got %d bytes, want %d matching cluster bytes", len(got), len(cluster))
+	}
+}
+
+// TestTryConvertSizesSparseTail builds an image whose only allocated cluster
+// is the first one covered by the last L2 table, leaving an unallocated tail
+// of the remaining clusters in that table after it. The raw
+// output must still be sized to the full virtual disk, not just as far as
+// the last allocated cluster.
+func TestTryConvertSizesSparseTail(t *testing.T) {
+	clusterBits := uint32(9) // 512B clusters, keeps the sparse tail small enough to test
+	clusterSize := int64(1) << clusterBits
+	l2EntriesPerTable := clusterSize / 8
+	cluster := bytes.Repeat([]byte{0xEF}, int(clusterSize))
+
+	const l1Size = 4
+	const allocatedL1Index = l1Size - 1 // last L1 entry: a large unallocated range precedes it
+
+	image, virtualSize := buildQcow2SparseTail(t, clusterBits, l1Size, allocatedL1Index, cluster)
+	tailStart := int64(allocatedL1Index) * l2EntriesPerTable * clusterSize
+
+	destPath := filepath.Join(t.TempDir(), "disk.raw")
+
+	replay, preallocationApplied, err := TryConvert(bytes.NewReader(image), destPath, false)
+	if err != nil {
+		t.Fatalf("TryConvert returned error: %v", err)
+	}
+	if replay != nil {
+		t.Fatal("expected a nil replay reader on success")
+	}
+	if preallocationApplied {
+		t.Fatal("expected preallocationApplied to be false when not requested")
+	}
+
+	stat, err := os.Stat(destPath)
+	if err != nil {
+		t.Fatalf("stat converted image: %v", err)
+	}
+	if stat.Size() != virtualSize {
+		t.Fatalf("converted image size = %d, want %d (full virtual size)", stat.Size(), virtualSize)
+	}
+
+	got, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("reading converted image: %v", err)
+	}
+	if !bytes.Equal(got[tailStart:tailStart+clusterSize], cluster) {
+		t.Fatal("converted image does not have the allocated cluster at its expected offset")
+	}
+	if !bytes.Equal(got[:tailStart], make([]byte, tailStart)) {
+		t.Fatal("converted image has non-zero bytes before the allocated cluster")
+	}
+}
+
+func TestTryConvertAppliesPreallocation(t *testing.T) {
+	clusterBits := uint32(9)
+	clusterSize := int64(1) << clusterBits
+	l2EntriesPerTable := clusterSize / 8
+	cluster := bytes.Repeat([]byte{0x11}, int(clusterSize))
+
+	const l1Size = 3
+	const allocatedL1Index = 0
+
+	image, virtualSize := buildQcow2SparseTail(t, clusterBits, l1Size, allocatedL1Index, cluster)
+
+	destPath := filepath.Join(t.TempDir(), "disk.raw")
+
+	replay, preallocationApplied, err := TryConvert(bytes.NewReader(image), destPath, true)
+	if err != nil {
+		t.Fatalf("TryConvert returned error: %v", err)
+	}
+	if replay != nil {
+		t.Fatal("expected a nil replay reader on success")
+	}
+	if !preallocationApplied {
+		t.Fatal("expected preallocationApplied to be true when requested")
+	}
+
+	stat, err := os.Stat(destPath)
+	if err != nil {
+		t.Fatalf("stat converted image: %v", err)
+	}
+	if stat.Size() != virtualSize {
+		t.Fatalf("converted image size = %d, want %d", stat.Size(), virtualSize)
+	}
+
+	got, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("reading converted image: %v", err)
+	}
+	tailStart := int64(allocatedL1Index)*l2EntriesPerTable*clusterSize + clusterSize
+	if !bytes.Equal(got[tailStart:], make([]byte, virtualSize-tailStart)) {
+		t.Fatal("expected unallocated clusters to be materialized as zero bytes")
+	}
+}
+
+func TestTryConvertRejectsNonQcow2Stream(t *testing.T) {
+	destPath := filepath.Join(t.TempDir(), "disk.raw")
+
+	payload := bytes.Repeat([]byte{0x01}, 128)
+	replay, _, err := TryConvert(bytes.NewReader(payload), destPath, false)
+	if err == nil {
+		t.Fatal("expected an error for a non-qcow2 stream")
+	}
+	if replay == nil {
+		t.Fatal("expected a non-nil replay reader so the caller can fall back")
+	}
+
+	got, readErr := io.ReadAll(replay)
+	if readErr != nil {
+		t.Fatalf("reading replay stream: %v", readErr)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("replay reader did not reproduce the original stream")
+	}
+}
+
+// TestTryConvertHonorsZeroFlag builds an image whose only L2 entry carries a
+// stale, non-zero host offset alongside QCOW_OFLAG_ZERO — the combination
+// QEMU leaves behind after a discard. The cluster must convert as zero, not
+// as whatever garbage sits at that stale offset.
+func TestTryConvertHonorsZeroFlag(t *testing.T) {
+	clusterBits := uint32(16) // 64KiB clusters
+	clusterSize := int64(1) << clusterBits
+	cluster := bytes.Repeat([]byte{0xAB}, int(clusterSize))
+
+	image := buildQcow2V2(t, clusterBits, cluster)
+
+	l1Offset := alignUp(72, clusterSize)
+	l2Offset := binary.BigEndian.Uint64(image[l1Offset : l1Offset+8])
+	l2Entry := binary.BigEndian.Uint64(image[l2Offset : l2Offset+8])
+	binary.BigEndian.PutUint64(image[l2Offset:l2Offset+8], l2Entry|l2EntryZeroFlag)
+
+	destPath := filepath.Join(t.TempDir(), "disk.raw")
+
+	replay, _, err := TryConvert(bytes.NewReader(image), destPath, false)
+	if err != nil {
+		t.Fatalf("TryConvert returned error: %v", err)
+	}
+	if replay != nil {
+		t.Fatal("expected a nil replay reader on success")
+	}
+
+	got, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("reading converted image: %v", err)
+	}
+	if !bytes.Equal(got, make([]byte, clusterSize)) {
+		t.Fatal("expected a QCOW_OFLAG_ZERO cluster to convert as zero")
+	}
+}
+
+// TestTryConvertRejectsOutOfOrderDataCluster builds an image whose L2 entry
+// points back into the already-parsed metadata region instead of past it.
+// That can never happen in a real qemu-img convert output, so rather than
+// silently treating the cluster as unallocated (a zero hole that masks
+// whatever was actually at that stale offset), TryConvert must refuse to
+// stream it and fall back.
+func TestTryConvertRejectsOutOfOrderDataCluster(t *testing.T) {
+	clusterBits := uint32(16)
+	clusterSize := int64(1) << clusterBits
+	cluster := bytes.Repeat([]byte{0xAB}, int(clusterSize))
+
+	image := buildQcow2V2(t, clusterBits, cluster)
+
+	l1Offset := alignUp(72, clusterSize)
+	l2Offset := binary.BigEndian.Uint64(image[l1Offset : l1Offset+8])
+	// Point the data cluster back at the L1 table instead of its real,
+	// cluster-aligned data offset.
+	binary.BigEndian.PutUint64(image[l2Offset:l2Offset+8], uint64(l1Offset))
+
+	destPath := filepath.Join(t.TempDir(), "disk.raw")
+
+	replay, _, err := TryConvert(bytes.NewReader(image), destPath, false)
+	if err == nil {
+		t.Fatal("expected an error for a data cluster preceding the image's metadata")
+	}
+	if replay == nil {
+		t.Fatal("expected a non-nil replay reader so the caller can fall back")
+	}
+
+	got, readErr := io.ReadAll(replay)
+	if readErr != nil {
+		t.Fatalf("reading replay stream: %v", readErr)
+	}
+	if !bytes.Equal(got, image) {
+		t.Fatal("replay reader did not reproduce the original stream")
+	}
+}
+
+func TestTryConvertRejectsBackingFile(t *testing.T) {
+	clusterBits := uint32(16)
+	cluster := bytes.Repeat([]byte{0xCD}, int(int64(1)<<clusterBits))
+	image := buildQcow2V2(t, clusterBits, cluster)
+	binary.BigEndian.PutUint64(image[8:16], 1) // backing_file_offset != 0
+
+	destPath := filepath.Join(t.TempDir(), "disk.raw")
+
+	replay, _, err := TryConvert(bytes.NewReader(image), destPath, false)
+	if err == nil {
+		t.Fatal("expected an error for an image with a backing file")
+	}
+	if replay == nil {
+		t.Fatal("expected a non-nil replay reader so the caller can fall back")
+	}
+}
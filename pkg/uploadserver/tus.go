@@ -0,0 +1,391 @@
+/*
+ * This file is part of the CDI project
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * Copyright 2024 Red Hat, Inc.
+ *
+ */
+
+package uploadserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+	"kubevirt.io/containerized-data-importer/pkg/common"
+	"kubevirt.io/containerized-data-importer/pkg/uploadserver/codec"
+)
+
+// tus core protocol, see https://tus.io/protocols/resumable-upload
+const (
+	tusResumableVersion = "1.0.0"
+	tusUploadPath       = "/v1beta1/upload-tus"
+	tusContentType      = "application/offset+octet-stream"
+
+	headerTusResumable   = "Tus-Resumable"
+	headerTusVersion     = "Tus-Version"
+	headerTusExtension   = "Tus-Extension"
+	headerUploadLength   = "Upload-Length"
+	headerUploadOffset   = "Upload-Offset"
+	headerUploadMetadata = "Upload-Metadata"
+)
+
+// tusUploadInfo is the subset of a tus upload's state that needs to survive a pod
+// restart, so it is persisted alongside the partial data on the scratch volume.
+type tusUploadInfo struct {
+	Length      int64  `json:"length"`
+	Metadata    string `json:"metadata,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+}
+
+type tusUpload struct {
+	id   string
+	info tusUploadInfo
+	// mu serializes PATCH requests against this particular upload so that
+	// out of order/overlapping chunks can't corrupt the scratch file.
+	mu sync.Mutex
+}
+
+func (app *uploadServerApp) tusDataFile(id string) string {
+	return filepath.Join(common.ScratchDataDir, "tus-"+id+".data")
+}
+
+func (app *uploadServerApp) tusMetaFile(id string) string {
+	return filepath.Join(common.ScratchDataDir, "tus-"+id+".meta")
+}
+
+func newTusUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// lookupTusUpload returns the in-memory upload state, recovering it from the
+// metadata persisted on the scratch volume if this is the first request this
+// process has seen for id (e.g. after a pod restart mid-upload).
+func (app *uploadServerApp) lookupTusUpload(id string) *tusUpload {
+	app.mutex.Lock()
+	upload, ok := app.tusUploads[id]
+	app.mutex.Unlock()
+	if ok {
+		return upload
+	}
+
+	data, err := os.ReadFile(app.tusMetaFile(id))
+	if err != nil {
+		return nil
+	}
+
+	var info tusUploadInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		klog.Errorf("Corrupt tus metadata for upload %s: %v", id, err)
+		return nil
+	}
+
+	upload = &tusUpload{id: id, info: info}
+
+	app.mutex.Lock()
+	app.tusUploads[id] = upload
+	app.mutex.Unlock()
+
+	return upload
+}
+
+func (app *uploadServerApp) abortTusUpload(id string) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	app.uploading = false
+	app.processing = false
+	if app.activeTusUploadID == id {
+		app.activeTusUploadID = ""
+	}
+}
+
+func (app *uploadServerApp) cleanupTusUpload(id string) {
+	app.mutex.Lock()
+	delete(app.tusUploads, id)
+	app.mutex.Unlock()
+
+	if err := os.Remove(app.tusDataFile(id)); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("Failed to remove tus data file for upload %s: %v", id, err)
+	}
+	if err := os.Remove(app.tusMetaFile(id)); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("Failed to remove tus metadata file for upload %s: %v", id, err)
+	}
+}
+
+// tusCreateHandler implements the tus creation extension: POST Upload-Length
+// (and optionally Upload-Metadata) to start a new resumable upload.
+func (app *uploadServerApp) tusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(headerTusResumable, tusResumableVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set(headerTusVersion, tusResumableVersion)
+		w.Header().Set(headerTusExtension, "creation")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get(headerUploadLength), 10, 64)
+	if err != nil || length < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := newTusUploadID()
+	if err != nil {
+		klog.Errorf("Failed to generate tus upload id: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !app.validateShouldHandleRequest(w, r, []string{http.MethodPost}, id) {
+		return
+	}
+
+	info := tusUploadInfo{
+		Length:      length,
+		Metadata:    r.Header.Get(headerUploadMetadata),
+		ContentType: r.Header.Get(common.UploadContentTypeHeader),
+		Encoding:    r.Header.Get(uploadEncodingHeader),
+	}
+
+	metaBytes, err := json.Marshal(info)
+	if err != nil {
+		app.abortTusUpload(id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.WriteFile(app.tusMetaFile(id), metaBytes, 0600); err != nil {
+		klog.Errorf("Failed to persist tus metadata for upload %s: %v", id, err)
+		app.abortTusUpload(id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Create(app.tusDataFile(id))
+	if err != nil {
+		klog.Errorf("Failed to create tus scratch file for upload %s: %v", id, err)
+		app.abortTusUpload(id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	app.mutex.Lock()
+	app.tusUploads[id] = &tusUpload{id: id, info: info}
+	app.mutex.Unlock()
+	app.startProgress(length)
+
+	klog.Infof("Created tus upload %s, length %d", id, length)
+
+	w.Header().Set("Location", tusUploadPath+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusResourceHandler dispatches HEAD/PATCH requests against an existing upload.
+func (app *uploadServerApp) tusResourceHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, tusUploadPath+"/")
+	if id == "" || strings.Contains(id, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		app.tusHeadHandler(w, r, id)
+	case http.MethodPatch:
+		app.tusPatchHandler(w, r, id)
+	case http.MethodOptions:
+		w.Header().Set(headerTusResumable, tusResumableVersion)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *uploadServerApp) tusHeadHandler(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set(headerTusResumable, tusResumableVersion)
+
+	upload := app.lookupTusUpload(id)
+	if upload == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	stat, err := os.Stat(app.tusDataFile(id))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(headerUploadOffset, strconv.FormatInt(stat.Size(), 10))
+	w.Header().Set(headerUploadLength, strconv.FormatInt(upload.info.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusPatchHandler appends a chunk to the upload's scratch file and, once the
+// full Upload-Length has been received, hands the assembled stream off to the
+// existing processing pipeline.
+func (app *uploadServerApp) tusPatchHandler(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set(headerTusResumable, tusResumableVersion)
+
+	if r.Header.Get("Content-Type") != tusContentType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if !app.validateShouldHandleRequest(w, r, []string{http.MethodPatch}, id) {
+		return
+	}
+
+	upload := app.lookupTusUpload(id)
+	if upload == nil {
+		app.abortTusUpload(id)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	dataFile := app.tusDataFile(id)
+	stat, err := os.Stat(dataFile)
+	if err != nil {
+		app.abortTusUpload(id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get(headerUploadOffset), 10, 64)
+	if err != nil || offset != stat.Size() {
+		// Client and server disagree on where the stream left off; the client
+		// is expected to HEAD for the real offset and retry. The upload stays
+		// open so this doesn't kill an otherwise-resumable transfer.
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	algo, want, err := parseChecksumHeader(r.Header.Get(uploadChecksumHeader))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var body io.Reader = app.countingUploadReader(r.Body)
+	var chunkHash hash.Hash
+	if algo != "" {
+		if chunkHash, err = newChecksumHash(algo); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = io.TeeReader(body, chunkHash)
+	}
+
+	f, err := os.OpenFile(dataFile, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		app.abortTusUpload(id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	written, err := io.Copy(f, body)
+	f.Close()
+	if err != nil {
+		klog.Errorf("Error writing tus chunk for upload %s: %v", id, err)
+		app.abortTusUpload(id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if chunkHash != nil {
+		if verifyErr := verifyChecksum(chunkHash, want); verifyErr != nil {
+			klog.Warningf("Checksum mismatch on chunk for tus upload %s: %v", id, verifyErr)
+			if truncErr := os.Truncate(dataFile, offset); truncErr != nil {
+				klog.Errorf("Failed to roll back corrupt chunk for tus upload %s: %v", id, truncErr)
+			}
+			w.Header().Set(headerUploadOffset, strconv.FormatInt(offset, 10))
+			w.WriteHeader(statusChecksumMismatch)
+			return
+		}
+	}
+
+	newOffset := offset + written
+	w.Header().Set(headerUploadOffset, strconv.FormatInt(newOffset, 10))
+
+	if newOffset < upload.info.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	app.completeTusUpload(w, id, upload)
+}
+
+func (app *uploadServerApp) completeTusUpload(w http.ResponseWriter, id string, upload *tusUpload) {
+	f, err := os.Open(app.tusDataFile(id))
+	if err != nil {
+		app.abortTusUpload(id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	app.mutex.Lock()
+	app.uploading = false
+	app.processing = true
+	app.mutex.Unlock()
+
+	processingStart := time.Now()
+	preallocationApplied, err := uploadProcessorFunc(f, app.destination, app.imageSize, app.filesystemOverhead, app.preallocation, upload.info.ContentType, cdiv1.DataVolumeKubeVirt, codec.Name(upload.info.Encoding), app.qcow2StreamOptimized)
+	processingDurationSeconds.Observe(time.Since(processingStart).Seconds())
+
+	app.cleanupTusUpload(id)
+
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+
+	app.processing = false
+	app.activeTusUploadID = ""
+
+	if err != nil {
+		klog.Errorf("Saving tus stream failed: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	app.preallocationApplied = preallocationApplied
+	app.recordPreallocationApplied(preallocationApplied)
+	app.done = true
+	close(app.doneChan)
+
+	klog.Infof("Wrote tus upload %s to %s", id, app.destination)
+	w.WriteHeader(http.StatusNoContent)
+}
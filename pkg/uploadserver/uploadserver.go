@@ -35,7 +35,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/pkg/errors"
 
 	"k8s.io/klog/v2"
@@ -43,6 +42,8 @@ import (
 	cdiv1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
 	"kubevirt.io/containerized-data-importer/pkg/common"
 	"kubevirt.io/containerized-data-importer/pkg/importer"
+	"kubevirt.io/containerized-data-importer/pkg/uploadserver/codec"
+	"kubevirt.io/containerized-data-importer/pkg/uploadserver/qcow2stream"
 	"kubevirt.io/containerized-data-importer/pkg/util"
 	cryptowatch "kubevirt.io/containerized-data-importer/pkg/util/tls-crypto-watch"
 )
@@ -50,6 +51,13 @@ import (
 const (
 	healthzPort = 8080
 	healthzPath = "/healthz"
+
+	// uploadEncodingHeader lets the clone source/upload-proxy negotiate a
+	// compression codec for the stream; see the codec package for the set of
+	// supported values. Omitting the header preserves the historical
+	// Snappy-only behavior for clone streams; the archive manifest endpoint
+	// instead reads an uncompressed tar when the header is absent.
+	uploadEncodingHeader = "X-CDI-Upload-Encoding"
 )
 
 // UploadServer is the interface to uploadServerApp
@@ -59,27 +67,33 @@ type UploadServer interface {
 }
 
 type uploadServerApp struct {
-	bindAddress          string
-	bindPort             int
-	destination          string
-	tlsKey               string
-	tlsCert              string
-	clientCert           string
-	clientName           string
-	cryptoConfig         cryptowatch.CryptoConfig
-	keyFile              string
-	certFile             string
-	imageSize            string
-	filesystemOverhead   float64
-	preallocation        bool
-	mux                  *http.ServeMux
-	uploading            bool
-	processing           bool
-	done                 bool
-	preallocationApplied bool
-	doneChan             chan struct{}
-	errChan              chan error
-	mutex                sync.Mutex
+	bindAddress           string
+	bindPort              int
+	destination           string
+	tlsKey                string
+	tlsCert               string
+	clientCert            string
+	clientName            string
+	cryptoConfig          cryptowatch.CryptoConfig
+	keyFile               string
+	certFile              string
+	imageSize             string
+	filesystemOverhead    float64
+	preallocation         bool
+	qcow2StreamOptimized  bool
+	mux                   *http.ServeMux
+	uploading             bool
+	processing            bool
+	done                  bool
+	preallocationApplied  bool
+	doneChan              chan struct{}
+	errChan               chan error
+	mutex                 sync.Mutex
+	tusUploads            map[string]*tusUpload
+	activeTusUploadID     string
+	progressBytesReceived int64
+	progressTotalBytes    int64
+	progressStartedAt     time.Time
 }
 
 type imageReadCloser func(*http.Request) (io.ReadCloser, error)
@@ -116,25 +130,32 @@ func formReadCloser(r *http.Request) (io.ReadCloser, error) {
 	return filePart, nil
 }
 
-// NewUploadServer returns a new instance of uploadServerApp
-func NewUploadServer(bindAddress string, bindPort int, destination, tlsKey, tlsCert, clientCert, clientName, imageSize string, filesystemOverhead float64, preallocation bool, cryptoConfig cryptowatch.CryptoConfig) UploadServer {
+// NewUploadServer returns a new instance of uploadServerApp. qcow2StreamOptimized
+// opts into converting a qcow2 upload directly onto its destination offsets as
+// it arrives, instead of staging the whole image on the scratch volume first;
+// see pkg/uploadserver/qcow2stream for the cases it can and can't handle. It
+// applies to the synchronous and tus upload paths only; the async upload path
+// always uses the scratch-based conversion.
+func NewUploadServer(bindAddress string, bindPort int, destination, tlsKey, tlsCert, clientCert, clientName, imageSize string, filesystemOverhead float64, preallocation, qcow2StreamOptimized bool, cryptoConfig cryptowatch.CryptoConfig) UploadServer {
 	server := &uploadServerApp{
-		bindAddress:        bindAddress,
-		bindPort:           bindPort,
-		destination:        destination,
-		tlsKey:             tlsKey,
-		tlsCert:            tlsCert,
-		clientCert:         clientCert,
-		clientName:         clientName,
-		cryptoConfig:       cryptoConfig,
-		filesystemOverhead: filesystemOverhead,
-		preallocation:      preallocation,
-		imageSize:          imageSize,
-		mux:                http.NewServeMux(),
-		uploading:          false,
-		done:               false,
-		doneChan:           make(chan struct{}),
-		errChan:            make(chan error),
+		bindAddress:          bindAddress,
+		bindPort:             bindPort,
+		destination:          destination,
+		tlsKey:               tlsKey,
+		tlsCert:              tlsCert,
+		clientCert:           clientCert,
+		clientName:           clientName,
+		cryptoConfig:         cryptoConfig,
+		filesystemOverhead:   filesystemOverhead,
+		preallocation:        preallocation,
+		qcow2StreamOptimized: qcow2StreamOptimized,
+		imageSize:            imageSize,
+		mux:                  http.NewServeMux(),
+		uploading:            false,
+		done:                 false,
+		doneChan:             make(chan struct{}),
+		errChan:              make(chan error),
+		tusUploads:           make(map[string]*tusUpload),
 	}
 
 	for _, path := range common.SyncUploadPaths {
@@ -152,6 +173,10 @@ func NewUploadServer(bindAddress string, bindPort int, destination, tlsKey, tlsC
 	for _, path := range common.AsyncUploadFormPaths {
 		server.mux.HandleFunc(path, server.uploadHandlerAsync(formReadCloser))
 	}
+	server.mux.HandleFunc(tusUploadPath, server.tusCreateHandler)
+	server.mux.HandleFunc(tusUploadPath+"/", server.tusResourceHandler)
+	server.mux.HandleFunc(archiveManifestUploadPath, server.archiveManifestHandler(bodyReadCloser))
+	server.mux.HandleFunc(progressPath, server.progressHandler)
 
 	return server
 }
@@ -261,6 +286,7 @@ func (app *uploadServerApp) createUploadServer() (*http.Server, error) {
 func (app *uploadServerApp) createHealthzServer() (*http.Server, error) {
 	mux := http.NewServeMux()
 	mux.HandleFunc(healthzPath, app.healthzHandler)
+	mux.Handle(metricsPath, metricsHandler())
 	return &http.Server{
 		Handler:           mux,
 		ReadHeaderTimeout: 10 * time.Second,
@@ -277,8 +303,22 @@ func (app *uploadServerApp) healthzHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
-func (app *uploadServerApp) validateShouldHandleRequest(w http.ResponseWriter, r *http.Request) bool {
-	if r.Method != http.MethodPost {
+// validateShouldHandleRequest gates every upload-accepting endpoint. A
+// non-empty tusUploadID identifies a tus PATCH/POST belonging to an
+// in-progress resumable upload; requests sharing the currently active tus
+// upload's id are let through even while the server is marked uploading, so a
+// multi-chunk tus transfer doesn't trip its own concurrency check. Requests
+// for a different upload are still rejected as concurrent.
+func (app *uploadServerApp) validateShouldHandleRequest(w http.ResponseWriter, r *http.Request, allowedMethods []string, tusUploadID string) bool {
+	methodAllowed := false
+	for _, method := range allowedMethods {
+		if r.Method == method {
+			methodAllowed = true
+			break
+		}
+	}
+	if !methodAllowed {
+		validationFailuresTotal.Inc()
 		w.WriteHeader(http.StatusNotFound)
 		return false
 	}
@@ -294,6 +334,7 @@ func (app *uploadServerApp) validateShouldHandleRequest(w http.ResponseWriter, r
 		}
 
 		if !found {
+			validationFailuresTotal.Inc()
 			w.WriteHeader(http.StatusUnauthorized)
 			return false
 		}
@@ -304,19 +345,26 @@ func (app *uploadServerApp) validateShouldHandleRequest(w http.ResponseWriter, r
 	app.mutex.Lock()
 	defer app.mutex.Unlock()
 
-	if app.uploading || app.processing {
+	sameTusUpload := tusUploadID != "" && app.activeTusUploadID == tusUploadID
+
+	if (app.uploading || app.processing) && !sameTusUpload {
 		klog.Warning("Got concurrent upload request")
+		validationFailuresTotal.Inc()
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return false
 	}
 
 	if app.done {
 		klog.Warning("Got upload request after already done")
+		validationFailuresTotal.Inc()
 		w.WriteHeader(http.StatusConflict)
 		return false
 	}
 
 	app.uploading = true
+	if tusUploadID != "" {
+		app.activeTusUploadID = tusUploadID
+	}
 
 	return true
 }
@@ -328,20 +376,42 @@ func (app *uploadServerApp) uploadHandlerAsync(irc imageReadCloser) http.Handler
 			return
 		}
 
-		if !app.validateShouldHandleRequest(w, r) {
+		if !app.validateShouldHandleRequest(w, r, []string{http.MethodPost}, "") {
 			return
 		}
 
 		cdiContentType := r.Header.Get(common.UploadContentTypeHeader)
+		encoding := codec.Name(r.Header.Get(uploadEncodingHeader))
 
-		klog.Infof("Content type header is %q\n", cdiContentType)
+		klog.Infof("Content type header is %q, encoding is %q\n", cdiContentType, encoding)
+
+		verifier, err := newChecksumVerifier(r.Header.Get(uploadChecksumHeader))
+		if err != nil {
+			klog.Errorf("Invalid %s header: %v", uploadChecksumHeader, err)
+			app.mutex.Lock()
+			app.uploading = false
+			app.mutex.Unlock()
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
 		readCloser, err := irc(r)
 		if err != nil {
+			app.mutex.Lock()
+			app.uploading = false
+			app.mutex.Unlock()
 			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		app.startProgress(r.ContentLength)
+		readCloser = app.countingUploadReader(readCloser)
+		if verifier != nil {
+			readCloser = verifier.wrap(readCloser)
 		}
 
-		processor, err := uploadProcessorFuncAsync(readCloser, app.destination, app.imageSize, app.filesystemOverhead, app.preallocation, cdiContentType)
+		uploadStart := time.Now()
+		processor, err := uploadProcessorFuncAsync(readCloser, app.destination, app.imageSize, app.filesystemOverhead, app.preallocation, cdiContentType, encoding)
+		uploadDurationSeconds.Observe(time.Since(uploadStart).Seconds())
 
 		app.mutex.Lock()
 
@@ -370,7 +440,16 @@ func (app *uploadServerApp) uploadHandlerAsync(irc imageReadCloser) http.Handler
 		// Start processing.
 		go func() {
 			defer close(app.doneChan)
-			if err := processor.ProcessDataResume(); err != nil {
+			processingStart := time.Now()
+			err := processor.ProcessDataResume()
+			processingDurationSeconds.Observe(time.Since(processingStart).Seconds())
+			if err == nil && verifier != nil {
+				if verifyErr := verifier.verify(); verifyErr != nil {
+					err = verifyErr
+					app.cleanupFailedDestination(app.destination)
+				}
+			}
+			if err != nil {
 				klog.Errorf("Error during resumed processing: %v", err)
 				app.errChan <- err
 			}
@@ -379,6 +458,7 @@ func (app *uploadServerApp) uploadHandlerAsync(irc imageReadCloser) http.Handler
 			app.processing = false
 			app.done = true
 			app.preallocationApplied = processor.PreallocationApplied()
+			app.recordPreallocationApplied(app.preallocationApplied)
 			klog.Infof("Wrote data to %s", app.destination)
 		}()
 
@@ -387,33 +467,74 @@ func (app *uploadServerApp) uploadHandlerAsync(irc imageReadCloser) http.Handler
 }
 
 func (app *uploadServerApp) processUpload(irc imageReadCloser, w http.ResponseWriter, r *http.Request, dvContentType cdiv1.DataVolumeContentType) {
-	if !app.validateShouldHandleRequest(w, r) {
+	if !app.validateShouldHandleRequest(w, r, []string{http.MethodPost}, "") {
 		return
 	}
 
 	cdiContentType := r.Header.Get(common.UploadContentTypeHeader)
+	encoding := codec.Name(r.Header.Get(uploadEncodingHeader))
 
-	klog.Infof("Content type header is %q\n", cdiContentType)
+	klog.Infof("Content type header is %q, encoding is %q\n", cdiContentType, encoding)
 
-	readCloser, err := irc(r)
+	verifier, err := newChecksumVerifier(r.Header.Get(uploadChecksumHeader))
 	if err != nil {
+		klog.Errorf("Invalid %s header: %v", uploadChecksumHeader, err)
+		app.mutex.Lock()
+		app.uploading = false
+		app.mutex.Unlock()
 		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	app.preallocationApplied, err = uploadProcessorFunc(readCloser, app.destination, app.imageSize, app.filesystemOverhead, app.preallocation, cdiContentType, dvContentType)
+	readCloser, err := irc(r)
+	if err != nil {
+		app.mutex.Lock()
+		app.uploading = false
+		app.mutex.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	app.startProgress(r.ContentLength)
+	readCloser = app.countingUploadReader(readCloser)
+	if verifier != nil {
+		readCloser = verifier.wrap(readCloser)
+	}
+
+	// Reading, decoding and writing happen interleaved inside a single
+	// uploadProcessorFunc call for this path, so there's no clean split
+	// between "upload" and "processing" time; the same elapsed duration is
+	// recorded into both histograms rather than faking a false separation.
+	start := time.Now()
+	app.preallocationApplied, err = uploadProcessorFunc(readCloser, app.destination, app.imageSize, app.filesystemOverhead, app.preallocation, cdiContentType, dvContentType, encoding, app.qcow2StreamOptimized)
+	elapsed := time.Since(start).Seconds()
+	uploadDurationSeconds.Observe(elapsed)
+	processingDurationSeconds.Observe(elapsed)
+
+	checksumFailed := false
+	if err == nil && verifier != nil {
+		if err = verifier.verify(); err != nil {
+			checksumFailed = true
+		}
+	}
 
 	app.mutex.Lock()
 	defer app.mutex.Unlock()
 
 	if err != nil {
 		klog.Errorf("Saving stream failed: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		if checksumFailed {
+			app.cleanupFailedDestination(app.destination)
+			w.WriteHeader(statusChecksumMismatch)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		app.uploading = false
 		return
 	}
 
 	app.uploading = false
 	app.done = true
+	app.recordPreallocationApplied(app.preallocationApplied)
 
 	close(app.doneChan)
 
@@ -440,33 +561,62 @@ func (app *uploadServerApp) PreallocationApplied() bool {
 	return app.preallocationApplied
 }
 
-func newAsyncUploadStreamProcessor(stream io.ReadCloser, dest, imageSize string, filesystemOverhead float64, preallocation bool, sourceContentType string) (*importer.DataProcessor, error) {
+func newAsyncUploadStreamProcessor(stream io.ReadCloser, dest, imageSize string, filesystemOverhead float64, preallocation bool, sourceContentType string, encoding codec.Name) (*importer.DataProcessor, error) {
 	if sourceContentType == common.FilesystemCloneContentType {
 		return nil, fmt.Errorf("async filesystem clone not supported")
 	}
 
-	uds := importer.NewAsyncUploadDataSource(newContentReader(stream, sourceContentType))
+	contentReader, err := newContentReader(stream, sourceContentType, encoding)
+	if err != nil {
+		return nil, errors.Wrap(err, "error negotiating upload encoding")
+	}
+
+	uds := importer.NewAsyncUploadDataSource(contentReader)
 	processor := importer.NewDataProcessor(uds, dest, common.ImporterVolumePath, common.ScratchDataDir, imageSize, filesystemOverhead, preallocation, "")
 	return processor, processor.ProcessDataWithPause()
 }
 
-func newUploadStreamProcessor(stream io.ReadCloser, dest, imageSize string, filesystemOverhead float64, preallocation bool, sourceContentType string, dvContentType cdiv1.DataVolumeContentType) (bool, error) {
+func newUploadStreamProcessor(stream io.ReadCloser, dest, imageSize string, filesystemOverhead float64, preallocation bool, sourceContentType string, dvContentType cdiv1.DataVolumeContentType, encoding codec.Name, qcow2StreamOptimized bool) (bool, error) {
 	if sourceContentType == common.FilesystemCloneContentType {
-		return false, filesystemCloneProcessor(stream, dest)
+		return false, filesystemCloneProcessor(stream, dest, encoding)
+	}
+
+	contentReader, err := newContentReader(stream, sourceContentType, encoding)
+	if err != nil {
+		return false, errors.Wrap(err, "error negotiating upload encoding")
+	}
+
+	if qcow2StreamOptimized && dvContentType == cdiv1.DataVolumeKubeVirt {
+		replay, preallocationApplied, convertErr := qcow2stream.TryConvert(contentReader, dest, preallocation)
+		if convertErr == nil {
+			klog.Infof("Converted qcow2 upload directly to %s without scratch staging", dest)
+			return preallocationApplied, nil
+		}
+		if replay == nil {
+			// already committed to writing dest directly; can't fall back
+			return false, convertErr
+		}
+		klog.Infof("Falling back to scratch-based conversion for %s: %v", dest, convertErr)
+		contentReader = io.NopCloser(replay)
 	}
 
 	// Clone block device to block device or file system
-	uds := importer.NewUploadDataSource(newContentReader(stream, sourceContentType), dvContentType)
+	uds := importer.NewUploadDataSource(contentReader, dvContentType)
 	processor := importer.NewDataProcessor(uds, dest, common.ImporterVolumePath, common.ScratchDataDir, imageSize, filesystemOverhead, preallocation, "")
-	err := processor.ProcessData()
+	err = processor.ProcessData()
 	return processor.PreallocationApplied(), err
 }
 
 // Clone file system to block device or file system
-func filesystemCloneProcessor(stream io.ReadCloser, dest string) error {
+func filesystemCloneProcessor(stream io.ReadCloser, dest string, encoding codec.Name) error {
+	decodedStream, err := codec.NewReader(stream, encoding)
+	if err != nil {
+		return errors.Wrap(err, "error negotiating upload encoding")
+	}
+
 	// Clone to block device
 	if dest == common.WriteBlockPath {
-		if err := untarToBlockdev(newSnappyReadCloser(stream), dest); err != nil {
+		if err := untarToBlockdev(decodedStream, dest); err != nil {
 			return errors.Wrapf(err, "error unarchiving to %s", dest)
 		}
 		return nil
@@ -474,7 +624,7 @@ func filesystemCloneProcessor(stream io.ReadCloser, dest string) error {
 
 	// Clone to file system
 	destDir := common.ImporterVolumePath
-	if err := util.UnArchiveTar(newSnappyReadCloser(stream), destDir); err != nil {
+	if err := util.UnArchiveTar(decodedStream, destDir); err != nil {
 		return errors.Wrapf(err, "error unarchiving to %s", destDir)
 	}
 	return nil
@@ -513,14 +663,10 @@ func untarToBlockdev(stream io.Reader, dest string) error {
 	}
 }
 
-func newContentReader(stream io.ReadCloser, contentType string) io.ReadCloser {
+func newContentReader(stream io.ReadCloser, contentType string, encoding codec.Name) (io.ReadCloser, error) {
 	if contentType == common.BlockdeviceClone {
-		return newSnappyReadCloser(stream)
+		return codec.NewReader(stream, encoding)
 	}
 
-	return stream
-}
-
-func newSnappyReadCloser(stream io.ReadCloser) io.ReadCloser {
-	return io.NopCloser(snappy.NewReader(stream))
+	return stream, nil
 }